@@ -16,12 +16,12 @@ package tp
 
 import (
 	"context"
-	"crypto/tls"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/henrylee2cn/goutil/pool"
+	"github.com/henrylee2cn/teleport/sched"
 	"github.com/henrylee2cn/teleport/socket"
 	"github.com/henrylee2cn/teleport/utils"
 )
@@ -32,6 +32,7 @@ const (
 	TypePull      byte = 1
 	TypeReply     byte = 2 // reply to pull
 	TypePush      byte = 3
+	TypeCancel    byte = 4 // best-effort cancellation of an in-flight pull
 )
 
 // TypeText returns the packet type text.
@@ -60,6 +61,11 @@ const (
 	CodeNotFound        = 404
 	CodePtypeNotAllowed = 405
 	CodeHandleTimeout   = 408
+	// CodeServiceUnavailable is returned for a PULL/REPLY-expecting packet
+	// whose Peer rejected it outright because its scheduler's dispatcher
+	// queues (or, for a session-scoped pull, that session's concurrency
+	// cap) were full.
+	CodeServiceUnavailable = 503
 
 	// CodeConflict                      = 409
 	// CodeUnsupportedTx                 = 410
@@ -67,7 +73,6 @@ const (
 	// CodeUnauthorized                  = 401
 	// CodeInternalServerError           = 500
 	// CodeBadGateway                    = 502
-	// CodeServiceUnavailable            = 503
 	// CodeGatewayTimeout                = 504
 	// CodeVariantAlsoNegotiates         = 506
 	// CodeInsufficientStorage           = 507
@@ -94,6 +99,8 @@ func CodeText(rerrCode int32) string {
 		return "Handle Timeout"
 	case CodePtypeNotAllowed:
 		return "Packet Type Not Allowed"
+	case CodeServiceUnavailable:
+		return "Service Unavailable"
 	case CodeUnknownError:
 		fallthrough
 	default:
@@ -111,6 +118,7 @@ var (
 	rerrNotFound            = NewRerror(CodeNotFound, CodeText(CodeNotFound), "")
 	rerrCodePtypeNotAllowed = NewRerror(CodePtypeNotAllowed, CodeText(CodePtypeNotAllowed), "")
 	rerrHandleTimeout       = NewRerror(CodeHandleTimeout, CodeText(CodeHandleTimeout), "")
+	rerrServiceUnavailable  = NewRerror(CodeServiceUnavailable, CodeText(CodeServiceUnavailable), "")
 )
 
 // IsConnRerror determines whether the error is a connection error
@@ -131,6 +139,12 @@ const (
 	MetaRealId = "X-Real-ID"
 	// MetaRealIp real IP metadata key
 	MetaRealIp = "X-Real-IP"
+	// MetaDeadline carries the sender's remaining context deadline, in
+	// milliseconds, so it can be reconstructed on the receiving peer.
+	MetaDeadline = "X-Tp-Deadline-Ms"
+	// MetaCtxPrefix prefixes metadata keys generated for context values
+	// registered via RegisterPropagatedKey.
+	MetaCtxPrefix = "X-Tp-Ctx-"
 )
 
 // WithRealId sets the real ID to metadata.
@@ -199,26 +213,37 @@ var GetPacket = socket.GetPacket
 //  func PutPacket(p *socket.Packet)
 var PutPacket = socket.PutPacket
 
-var (
-	_maxGoroutinesAmount      = (1024 * 1024 * 8) / 8 // max memory 8GB (8KB/goroutine)
-	_maxGoroutineIdleDuration time.Duration
-	_gopool                   = pool.NewGoPool(_maxGoroutinesAmount, _maxGoroutineIdleDuration)
-)
+// _scheduler is the default scheduler backing the package-level Go and
+// AnywayGo helpers. A *Peer normally owns its own *sched.Scheduler
+// instead; these helpers remain as a thin facade over a shared default
+// for callers that don't need per-peer isolation. It is held in an
+// atomic.Value since SetScheduler may replace it concurrently with Go().
+var _scheduler atomic.Value // sched.Config -> *sched.Scheduler
 
-// SetGopool set or reset go pool config.
+func init() {
+	_scheduler.Store(sched.New(sched.SchedElastic(1, (1024*1024*8)/8))) // max memory 8GB (8KB/goroutine)
+}
+
+// SetScheduler replaces the default scheduler used by Go and AnywayGo.
 // Note: Make sure to call it before calling NewPeer() and Go()
+func SetScheduler(cfg sched.Config) {
+	old := _scheduler.Load().(*sched.Scheduler)
+	_scheduler.Store(sched.New(cfg))
+	old.Stop()
+}
+
+// SetGopool set or reset go pool config.
+// Deprecated: use SetScheduler instead; this now just configures the
+// default scheduler's worker bounds.
 func SetGopool(maxGoroutinesAmount int, maxGoroutineIdleDuration time.Duration) {
-	_maxGoroutinesAmount, _maxGoroutineIdleDuration := maxGoroutinesAmount, maxGoroutineIdleDuration
-	if _gopool != nil {
-		_gopool.Stop()
-	}
-	_gopool = pool.NewGoPool(_maxGoroutinesAmount, _maxGoroutineIdleDuration)
+	_ = maxGoroutineIdleDuration
+	SetScheduler(sched.SchedElastic(1, maxGoroutinesAmount))
 }
 
 // Go similar to go func, but return false if insufficient resources.
 func Go(fn func()) bool {
-	if err := _gopool.Go(fn); err != nil {
-		Warnf("%s", err.Error())
+	if !_scheduler.Load().(*sched.Scheduler).Go(fn) {
+		Warnf("%s", "scheduler: rejected, dispatcher queues full")
 		return false
 	}
 	return true
@@ -293,31 +318,3 @@ func (f *fakePullCmd) InputMeta() *utils.Args {
 func (f *fakePullCmd) CostTime() time.Duration {
 	return 0
 }
-
-// NewTlsConfigFromFile creates a new TLS config.
-func NewTlsConfigFromFile(tlsCertFile, tlsKeyFile string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
-	if err != nil {
-		return nil, err
-	}
-	return &tls.Config{
-		Certificates:             []tls.Certificate{cert},
-		NextProtos:               []string{"http/1.1", "h2"},
-		PreferServerCipherSuites: true,
-		CurvePreferences: []tls.CurveID{
-			tls.CurveP256,
-			tls.X25519,
-		},
-		MinVersion: tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
-		},
-	}, nil
-}
@@ -0,0 +1,115 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/teleport/socket"
+	"github.com/henrylee2cn/teleport/utils"
+)
+
+// propagatedKeys are the context.Context value keys forwarded across the
+// wire as MetaCtxPrefix-prefixed metadata, registered via
+// RegisterPropagatedKey.
+var (
+	propagatedKeysMu sync.RWMutex
+	propagatedKeys   = map[string]interface{}{}
+)
+
+// RegisterPropagatedKey registers a context value key whose string value
+// should be propagated to the remote peer as wire metadata whenever a
+// packet is sent with a context carrying that key. key is used both as
+// the context.Value key and, under MetaCtxPrefix, as the metadata key
+// name, so it must be unique and stable across the cluster.
+func RegisterPropagatedKey(key string) {
+	propagatedKeysMu.Lock()
+	propagatedKeys[key] = key
+	propagatedKeysMu.Unlock()
+}
+
+// ctxMetaSettings returns the PacketSetting list that carries ctx's
+// remaining deadline and any registered propagated values as wire
+// metadata. It is a no-op (returns nil) when ctx has neither.
+func ctxMetaSettings(ctx context.Context) []socket.PacketSetting {
+	var settings []socket.PacketSetting
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := time.Until(deadline) / time.Millisecond
+		if ms < 0 {
+			ms = 0
+		}
+		settings = append(settings, socket.WithAddMeta(MetaDeadline, strconv.FormatInt(int64(ms), 10)))
+	}
+	propagatedKeysMu.RLock()
+	defer propagatedKeysMu.RUnlock()
+	for key := range propagatedKeys {
+		v := ctx.Value(key)
+		if v == nil {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		settings = append(settings, socket.WithAddMeta(MetaCtxPrefix+key, s))
+	}
+	return settings
+}
+
+// ctxFromMeta reconstructs, from an inbound packet's metadata, the
+// context that the remote peer's caller was holding: a context.WithTimeout
+// derived from MetaDeadline (or parent unchanged if absent) with every
+// MetaCtxPrefix-prefixed value attached. The returned CancelFunc must be
+// called once the handler invocation completes, to release the timer.
+func ctxFromMeta(parent context.Context, meta *utils.Args) (context.Context, context.CancelFunc) {
+	ctx := parent
+	cancel := func() {}
+	if ms := meta.Peek(MetaDeadline); len(ms) > 0 {
+		if n, err := strconv.ParseInt(string(ms), 10, 64); err == nil {
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(n)*time.Millisecond)
+		}
+	}
+	meta.VisitAll(func(key, value []byte) {
+		k := string(key)
+		if len(k) <= len(MetaCtxPrefix) || k[:len(MetaCtxPrefix)] != MetaCtxPrefix {
+			return
+		}
+		ctx = context.WithValue(ctx, k[len(MetaCtxPrefix):], string(value))
+	})
+	return ctx, cancel
+}
+
+// registerCancel records cancel under seq on p's own cancelRegistry, for
+// later lookup by handleCancelPacket. The registry is scoped to p (see
+// Peer.cancelRegistry) so that two unrelated in-flight pulls that happen
+// to share a sequence number, on a different connection or a different
+// Peer entirely, cannot cross-cancel each other. Call the returned func to
+// deregister once the handler invocation finishes normally.
+func (p *Peer) registerCancel(seq uint64, cancel context.CancelFunc) (deregister func()) {
+	p.cancelRegistry.Store(seq, cancel)
+	return func() { p.cancelRegistry.Delete(seq) }
+}
+
+// handleCancelPacket looks up and invokes the CancelFunc registered for
+// a received TypeCancel packet's sequence number. It is a no-op if the
+// handler has already finished (and deregistered) or never existed.
+func (p *Peer) handleCancelPacket(seq uint64) {
+	if v, ok := p.cancelRegistry.Load(seq); ok {
+		v.(context.CancelFunc)()
+	}
+}
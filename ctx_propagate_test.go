@@ -0,0 +1,139 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// TestNestedPullsShareDeadline verifies that a pull issued from within the
+// handler of another pull inherits the remaining budget of the original
+// caller's context, rather than starting a fresh deadline of its own.
+func TestNestedPullsShareDeadline(t *testing.T) {
+	outerCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	outerPacket := socket.GetPacket(append([]socket.PacketSetting{
+		socket.WithPtype(TypePull),
+		socket.WithUri("/outer"),
+	}, ctxMetaSettings(outerCtx)...)...)
+	defer socket.PutPacket(outerPacket)
+
+	// Simulate the receiving peer reconstructing the handler's context.
+	handlerCtx, handlerCancel := ctxFromMeta(context.Background(), outerPacket.Meta())
+	defer handlerCancel()
+
+	deadline, ok := handlerCtx.Deadline()
+	if !ok {
+		t.Fatal("expected handlerCtx to carry a deadline")
+	}
+	if time.Until(deadline) > 200*time.Millisecond {
+		t.Fatalf("handlerCtx deadline exceeds the original budget: %v remaining", time.Until(deadline))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// Simulate the handler issuing a nested pull using its own (already
+	// reconstructed) context.
+	nestedPacket := socket.GetPacket(append([]socket.PacketSetting{
+		socket.WithPtype(TypePull),
+		socket.WithUri("/nested"),
+	}, ctxMetaSettings(handlerCtx)...)...)
+	defer socket.PutPacket(nestedPacket)
+
+	nestedCtx, nestedCancel := ctxFromMeta(context.Background(), nestedPacket.Meta())
+	defer nestedCancel()
+
+	nestedDeadline, ok := nestedCtx.Deadline()
+	if !ok {
+		t.Fatal("expected nestedCtx to carry a deadline")
+	}
+	if !nestedDeadline.Before(deadline) {
+		t.Fatalf("nested pull must not get a deadline past the original: nested=%v original=%v", nestedDeadline, deadline)
+	}
+	if time.Until(nestedDeadline) <= 0 {
+		t.Fatal("nested pull's remaining deadline should still be positive")
+	}
+}
+
+// TestRegisterPropagatedKeyRoundTrip verifies that a value registered via
+// RegisterPropagatedKey survives a ctxMetaSettings/ctxFromMeta round trip.
+func TestRegisterPropagatedKeyRoundTrip(t *testing.T) {
+	const key = "test-trace-id"
+	RegisterPropagatedKey(key)
+
+	ctx := context.WithValue(context.Background(), key, "abc123")
+	p := socket.GetPacket(append([]socket.PacketSetting{
+		socket.WithPtype(TypePull),
+		socket.WithUri("/x"),
+	}, ctxMetaSettings(ctx)...)...)
+	defer socket.PutPacket(p)
+
+	reconstructed, cancel := ctxFromMeta(context.Background(), p.Meta())
+	defer cancel()
+
+	if v, _ := reconstructed.Value(key).(string); v != "abc123" {
+		t.Fatalf("expected propagated value %q, got %q", "abc123", v)
+	}
+}
+
+// TestHandleCancelPacket verifies that a TypeCancel packet's sequence
+// number preempts the matching in-flight handler's context.
+func TestHandleCancelPacket(t *testing.T) {
+	p := NewPeer(PeerConfig{})
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	deregister := p.registerCancel(42, cancel)
+	defer deregister()
+
+	p.handleCancelPacket(42)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected ctx to be canceled by handleCancelPacket")
+	}
+}
+
+// TestCancelRegistryScopedPerPeer verifies that two Peers (or, equivalently,
+// two unrelated connections) whose in-flight pulls happen to share a
+// sequence number cannot cross-cancel each other.
+func TestCancelRegistryScopedPerPeer(t *testing.T) {
+	p1 := NewPeer(PeerConfig{})
+	defer p1.Close()
+	p2 := NewPeer(PeerConfig{})
+	defer p2.Close()
+
+	_, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	deregister1 := p1.registerCancel(7, cancel1)
+	defer deregister1()
+	deregister2 := p2.registerCancel(7, cancel2)
+	defer deregister2()
+
+	p1.handleCancelPacket(7)
+
+	select {
+	case <-ctx2.Done():
+		t.Fatal("p1's TypeCancel must not preempt p2's handler for the same seq")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
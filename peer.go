@@ -0,0 +1,437 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/teleport/sched"
+	"github.com/henrylee2cn/teleport/socket"
+	"github.com/henrylee2cn/teleport/transport/http2"
+	"github.com/henrylee2cn/teleport/utils"
+)
+
+// Router dispatches a decoded input packet (PULL or PUSH) to the
+// registered handlers and returns the reply packet, or nil for PUSH.
+// It is invoked the same way regardless of which transport delivered the
+// packet.
+type Router func(ctx context.Context, input *socket.Packet) *socket.Packet
+
+// PeerConfig configures a Peer.
+type PeerConfig struct {
+	// CountTime enables PullCmd.CostTime tracking.
+	CountTime bool
+	// Router dispatches decoded packets into the registered handlers.
+	Router Router
+	// TlsConfig is used for "tls://" and "h2://" addresses in
+	// ListenAndServe/Dial.
+	TlsConfig *tls.Config
+	// Scheduler configures this Peer's own goroutine scheduler, isolated
+	// from every other Peer's. The zero value uses
+	// sched.SchedElastic(1, (1024*1024*8)/8).
+	Scheduler sched.Config
+	// StatsPlugins are notified of this Peer's scheduler load once a
+	// second, the same way other plugin hooks observe Peer activity.
+	StatsPlugins []StatsPlugin
+}
+
+// StatsPlugin is implemented by plugins that want visibility into a
+// Peer's scheduler load (queue depth, rejected submissions, running
+// tasks).
+type StatsPlugin interface {
+	OnSchedulerStats(stats sched.Stats)
+}
+
+// Peer is a teleport endpoint that can listen on, or dial, any of the
+// transports teleport supports. All of them funnel through the same
+// Router via readHandleCtx, so handlers behave identically regardless of
+// transport. Each Peer owns its own Scheduler, so a burst on one Peer
+// cannot starve another's.
+type Peer struct {
+	cfg        PeerConfig
+	h2Servers  []*http2.Server
+	scheduler  *sched.Scheduler
+	closeStats chan struct{}
+
+	// cancelRegistry maps an in-flight pull's sequence number to the
+	// context.CancelFunc of its handler invocation. It is scoped to this
+	// Peer (rather than a package-global) so that sequence numbers, which
+	// are small per-connection counters, cannot collide across unrelated
+	// connections or Peers and cross-cancel each other's handlers.
+	cancelRegistry sync.Map // map[uint64]context.CancelFunc
+}
+
+// NewPeer creates a Peer from cfg.
+func NewPeer(cfg PeerConfig) *Peer {
+	schedCfg := cfg.Scheduler
+	if schedCfg.MaxWorkers <= 0 {
+		schedCfg = sched.SchedElastic(1, (1024*1024*8)/8) // max memory 8GB (8KB/goroutine)
+		schedCfg.PerSessionConcurrency = cfg.Scheduler.PerSessionConcurrency
+	}
+	p := &Peer{
+		cfg:        cfg,
+		scheduler:  sched.New(schedCfg),
+		closeStats: make(chan struct{}),
+	}
+	if len(cfg.StatsPlugins) > 0 {
+		go p.reportStatsLoop()
+	}
+	return p
+}
+
+func (p *Peer) reportStatsLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.closeStats:
+			return
+		case <-t.C:
+			stats := p.scheduler.Stats()
+			for _, plugin := range p.cfg.StatsPlugins {
+				plugin.OnSchedulerStats(stats)
+			}
+		}
+	}
+}
+
+// Go submits fn on this Peer's own scheduler, isolated from every other
+// Peer's. It returns false if the scheduler's dispatcher queues are full.
+func (p *Peer) Go(fn func()) bool {
+	return p.scheduler.Go(fn)
+}
+
+// Close stops this Peer's scheduler and stats reporting. In-flight
+// listeners/connections are not closed.
+func (p *Peer) Close() error {
+	close(p.closeStats)
+	p.scheduler.Stop()
+	return nil
+}
+
+// readHandleCtx is the single entry point every transport calls with a
+// decoded packet and the address of the connection it arrived on (used to
+// scope scheduler session dispatch; raw transports pass the net.Conn's
+// remote address, http2 passes http.Request.RemoteAddr). For a TypeCancel
+// control packet it preempts the matching in-flight handler and returns
+// nil. Otherwise it reconstructs the caller's context from
+// MetaDeadline/MetaCtxPrefix metadata (see ctxFromMeta), registers it for
+// cancellation so a later TypeCancel can preempt it, and runs Router on
+// this Peer's own scheduler: PULL/REPLY packets are submitted at
+// sched.PriorityHigh so they preempt PUSH fan-out (sched.PriorityLow), and
+// when PeerConfig.Scheduler.PerSessionConcurrency is set the run is capped
+// per remoteAddr via GoSession instead of GoPriority.
+func (p *Peer) readHandleCtx(remoteAddr string, input *socket.Packet) *socket.Packet {
+	seq := input.Seq()
+	if input.Ptype() == TypeCancel {
+		p.handleCancelPacket(seq)
+		return nil
+	}
+	if p.cfg.Router == nil {
+		return nil
+	}
+	priority := sched.PriorityLow
+	if input.Ptype() == TypePull || input.Ptype() == TypeReply {
+		priority = sched.PriorityHigh
+	}
+
+	ctx, cancel := ctxFromMeta(context.Background(), input.Meta())
+	deregister := p.registerCancel(seq, cancel)
+	defer func() {
+		deregister()
+		cancel()
+	}()
+
+	done := make(chan *socket.Packet, 1)
+	fn := func() { done <- p.cfg.Router(ctx, input) }
+
+	var submitted bool
+	if p.cfg.Scheduler.PerSessionConcurrency > 0 && remoteAddr != "" {
+		submitted = p.scheduler.GoSession(remoteAddr, priority, fn)
+	} else {
+		submitted = p.scheduler.GoPriority(priority, fn)
+	}
+	if !submitted {
+		if input.Ptype() == TypePush {
+			return nil
+		}
+		return overloadedReply(input)
+	}
+	return <-done
+}
+
+// overloadedReply builds the TypeReply packet sent back when this Peer's
+// scheduler rejects input because every dispatcher's queue (or, for a
+// session-scoped pull, that remoteAddr's concurrency cap) is full.
+func overloadedReply(input *socket.Packet) *socket.Packet {
+	return socket.GetPacket(
+		socket.WithPtype(TypeReply),
+		socket.WithUri(input.Uri()),
+		socket.WithSeq(input.Seq()),
+		socket.WithAddMeta(MetaRerrorKey, CodeText(CodeServiceUnavailable)),
+	)
+}
+
+func splitScheme(addr string) (scheme, hostport string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "", addr
+}
+
+// ListenAndServe starts accepting connections on addr and dispatches
+// every decoded packet to PeerConfig.Router through readHandleCtx. addr's
+// scheme selects the transport:
+//  h2c://host:port  cleartext HTTP/2 (golang.org/x/net/http2/h2c)
+//  h2://host:port   HTTP/2 over TLS (PeerConfig.TlsConfig required)
+//  tls://host:port  raw socket over TLS (PeerConfig.TlsConfig required)
+//  host:port        raw TCP socket (no scheme)
+func (p *Peer) ListenAndServe(addr string) error {
+	scheme, hostport := splitScheme(addr)
+	switch scheme {
+	case "h2c":
+		srv := http2.NewServer(hostport, true, http2.Handler(p.readHandleCtx))
+		p.h2Servers = append(p.h2Servers, srv)
+		return srv.ListenAndServe()
+	case "h2":
+		if p.cfg.TlsConfig == nil {
+			return errors.New("tp: h2:// requires PeerConfig.TlsConfig")
+		}
+		srv := http2.NewServer(hostport, false, http2.Handler(p.readHandleCtx))
+		srv.TLSConfig = p.cfg.TlsConfig
+		p.h2Servers = append(p.h2Servers, srv)
+		return srv.ListenAndServeTLS("", "")
+	case "tls":
+		if p.cfg.TlsConfig == nil {
+			return errors.New("tp: tls:// requires PeerConfig.TlsConfig")
+		}
+		return p.listenRaw(hostport, p.cfg.TlsConfig)
+	default:
+		return p.listenRaw(hostport, nil)
+	}
+}
+
+func (p *Peer) listenRaw(addr string, tlsConfig *tls.Config) error {
+	var ln net.Listener
+	var err error
+	if tlsConfig != nil {
+		ln, err = tls.Listen("tcp", addr, tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		// Each connection gets its own lightweight goroutine that does
+		// nothing but read/write packets; the actual handler work for
+		// each packet is what goes through p.scheduler (see
+		// readHandleCtx), so accepted connections themselves are never
+		// bounded by, or competing for, scheduler dispatcher slots.
+		go p.serveRawConn(conn)
+	}
+}
+
+func (p *Peer) serveRawConn(conn net.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	sess := socket.NewSession(conn)
+	for {
+		input, err := sess.ReadPacket()
+		if err != nil {
+			return
+		}
+		output := p.readHandleCtx(remoteAddr, input)
+		if output != nil {
+			sess.WritePacket(output)
+			socket.PutPacket(output)
+		}
+		socket.PutPacket(input)
+	}
+}
+
+// Dial opens a client connection to addr, whose scheme is parsed exactly
+// as ListenAndServe does, and returns a Session for sending PULL/PUSH
+// packets through the same transports.
+func (p *Peer) Dial(addr string) (*Session, error) {
+	scheme, hostport := splitScheme(addr)
+	switch scheme {
+	case "h2c":
+		return &Session{peer: p, h2: http2.NewClient(hostport, true, nil)}, nil
+	case "h2":
+		if p.cfg.TlsConfig == nil {
+			return nil, errors.New("tp: h2:// requires PeerConfig.TlsConfig")
+		}
+		return &Session{peer: p, h2: http2.NewClient(hostport, false, p.cfg.TlsConfig)}, nil
+	case "tls":
+		if p.cfg.TlsConfig == nil {
+			return nil, errors.New("tp: tls:// requires PeerConfig.TlsConfig")
+		}
+		return p.dialRaw(hostport, p.cfg.TlsConfig)
+	default:
+		return p.dialRaw(hostport, nil)
+	}
+}
+
+func (p *Peer) dialRaw(addr string, tlsConfig *tls.Config) (*Session, error) {
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{peer: p, raw: socket.NewSession(conn), rawClosed: make(chan struct{})}
+	go s.rawReadLoop()
+	return s, nil
+}
+
+// Session is a client connection obtained from Peer.Dial.
+type Session struct {
+	peer *Peer
+	h2   *http2.Client
+	raw  *socket.Session
+
+	// rawPending maps an in-flight pullRaw call's sequence number to the
+	// channel its reply should be delivered on. A single rawReadLoop
+	// goroutine is the only reader of s.raw, so concurrent/reused pulls on
+	// the same raw Session never race on ReadPacket and a timed-out pull's
+	// stale reply can never be handed to a later, unrelated pull.
+	rawPending sync.Map // map[uint64]chan *socket.Packet
+	rawClosed  chan struct{}
+	rawErr     error
+}
+
+// rawReadLoop is the only goroutine that ever calls s.raw.ReadPacket, for
+// the lifetime of a dialed raw Session. It demultiplexes every inbound
+// packet to the pullRaw call awaiting that sequence number, or discards it
+// if no call is waiting (e.g. it arrived after that pull's context expired).
+func (s *Session) rawReadLoop() {
+	for {
+		pkt, err := s.raw.ReadPacket()
+		if err != nil {
+			s.rawErr = err
+			close(s.rawClosed)
+			return
+		}
+		if ch, ok := s.rawPending.Load(pkt.Seq()); ok {
+			s.rawPending.Delete(pkt.Seq())
+			ch.(chan *socket.Packet) <- pkt
+			continue
+		}
+		socket.PutPacket(pkt)
+	}
+}
+
+// Pull sends uri/args as a TypePull packet over whichever transport this
+// Session dialed and returns the PullCmd once a reply (or error) arrives.
+// If ctx carries a deadline, or values registered via RegisterPropagatedKey,
+// they are attached as wire metadata (ctxMetaSettings) so the remote
+// handler inherits the same budget; if ctx is canceled before the reply
+// arrives, a best-effort TypeCancel packet is sent for the same sequence.
+func (s *Session) Pull(ctx context.Context, uri string, args interface{}) PullCmd {
+	settings := append([]socket.PacketSetting{
+		socket.WithPtype(TypePull),
+		socket.WithUri(uri),
+		socket.WithBody(args),
+		socket.WithContext(ctx),
+	}, ctxMetaSettings(ctx)...)
+	output := socket.GetPacket(settings...)
+	var reply interface{}
+	var rerr *Rerror
+	if s.h2 != nil {
+		reply, rerr = s.pullHTTP2(ctx, output)
+	} else {
+		reply, rerr = s.pullRaw(ctx, output)
+	}
+	return &fakePullCmd{output: output, reply: reply, rerr: rerr, inputMeta: utils.AcquireArgs()}
+}
+
+// cancelPacket builds the best-effort TypeCancel control packet for an
+// in-flight pull identified by output's sequence and URI.
+func cancelPacket(output *socket.Packet) *socket.Packet {
+	return socket.GetPacket(
+		socket.WithPtype(TypeCancel),
+		socket.WithUri(output.Uri()),
+		socket.WithSeq(output.Seq()),
+	)
+}
+
+func (s *Session) pullHTTP2(ctx context.Context, output *socket.Packet) (interface{}, *Rerror) {
+	type result struct {
+		pkt *socket.Packet
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		pkt, err := s.h2.Send(output)
+		done <- result{pkt, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, NewRerror(CodeWriteFailed, CodeText(CodeWriteFailed), r.err.Error())
+		}
+		return r.pkt.Body(), nil
+	case <-ctx.Done():
+		cancel := cancelPacket(output)
+		go func() {
+			s.h2.Send(cancel)
+			socket.PutPacket(cancel)
+		}()
+		return nil, NewRerror(CodeHandleTimeout, CodeText(CodeHandleTimeout), ctx.Err().Error())
+	}
+}
+
+// pullRaw writes output and waits for rawReadLoop to demultiplex the
+// matching reply to it by sequence number. Unlike a one-off goroutine per
+// call, this never races a later pull on the same Session for ownership of
+// s.raw.ReadPacket, so a reply that arrives after ctx is done is simply
+// dropped by rawReadLoop instead of being handed to whichever pull reads
+// next.
+func (s *Session) pullRaw(ctx context.Context, output *socket.Packet) (interface{}, *Rerror) {
+	seq := output.Seq()
+	ch := make(chan *socket.Packet, 1)
+	s.rawPending.Store(seq, ch)
+	defer s.rawPending.Delete(seq)
+
+	if err := s.raw.WritePacket(output); err != nil {
+		return nil, NewRerror(CodeWriteFailed, CodeText(CodeWriteFailed), err.Error())
+	}
+	select {
+	case pkt := <-ch:
+		return pkt.Body(), nil
+	case <-s.rawClosed:
+		return nil, NewRerror(CodeConnClosed, CodeText(CodeConnClosed), s.rawErr.Error())
+	case <-ctx.Done():
+		cancel := cancelPacket(output)
+		s.raw.WritePacket(cancel)
+		socket.PutPacket(cancel)
+		return nil, NewRerror(CodeHandleTimeout, CodeText(CodeHandleTimeout), ctx.Err().Error())
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sched provides a per-peer goroutine scheduler: a bounded,
+// priority-aware replacement for a single process-global goroutine pool.
+// Each Scheduler owns a small set of OS-thread-pinned dispatchers that
+// each keep a local runqueue and steal work from one another when idle,
+// so a burst on one dispatcher doesn't starve the others.
+package sched
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority classes. Higher-priority tasks are dispatched before
+// lower-priority ones queued at the same time, so PULL/REPLY traffic can
+// preempt PUSH fan-out.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = int(PriorityHigh) + 1
+)
+
+// Config configures a Scheduler.
+type Config struct {
+	// MinWorkers is a floor on the number of dispatcher goroutines created
+	// by New (alongside the runtime.GOMAXPROCS(0)/MaxWorkers-derived
+	// count). It is fixed for the Scheduler's lifetime; the dispatcher
+	// count never changes while the Scheduler is running.
+	MinWorkers int
+	// MaxWorkers is the hard cap on concurrently running tasks.
+	MaxWorkers int
+	// QueueSize bounds how many pending tasks may wait before Go starts
+	// rejecting work. New splits it evenly across dispatchers, giving each
+	// dispatcher QueueSize/n+1 slots separately for every priority class.
+	QueueSize int
+	// PerSessionConcurrency caps how many tasks submitted under the same
+	// session key may run at once. Zero means unlimited.
+	PerSessionConcurrency int
+}
+
+// SchedFixed returns a Config with a fixed number of workers and no
+// elasticity, suitable for predictable, CPU-bound workloads.
+func SchedFixed(workers int) Config {
+	return Config{MinWorkers: workers, MaxWorkers: workers, QueueSize: workers * 64}
+}
+
+// SchedElastic returns a Config with a MinWorkers floor and a MaxWorkers
+// ceiling on dispatcher goroutines, suitable for bursty, mostly-idle
+// workloads where you want a small number of dispatchers always warm
+// without letting a burst grow dispatcher count unbounded. The dispatcher
+// count itself is fixed at New time (see Config.MinWorkers); it is
+// per-task concurrency, via Scheduler.sema, that actually responds to
+// load between min and max.
+func SchedElastic(min, max int) Config {
+	return Config{MinWorkers: min, MaxWorkers: max, QueueSize: max * 64}
+}
+
+// SchedPriority returns a Config like SchedElastic, documenting that
+// callers intend to use GoPriority to let PULL/REPLY traffic preempt
+// PUSH fan-out; priority dispatch is always active, this preset just
+// names the intent.
+func SchedPriority(min, max int) Config {
+	return SchedElastic(min, max)
+}
+
+type task struct {
+	fn      func()
+	session string
+}
+
+// Stats reports a Scheduler's current load.
+type Stats struct {
+	// QueueDepth is the number of tasks currently queued, not yet running.
+	QueueDepth int64
+	// Rejected is the cumulative number of Go/GoPriority/GoSession calls
+	// that were rejected because every dispatcher's queue was full or, for
+	// GoSession, the session was at its concurrency cap.
+	Rejected int64
+	// Running is the number of tasks currently executing.
+	Running int64
+}
+
+// Scheduler is a bounded, priority-aware, work-stealing goroutine pool
+// owned by a single Peer.
+type Scheduler struct {
+	cfg   Config
+	disps []*dispatcher
+
+	sema chan struct{} // bounds total concurrently running tasks to cfg.MaxWorkers
+
+	queueDepth int64
+	rejected   int64
+	running    int64
+
+	sessionsMu sync.Mutex
+	sessions   map[string]chan struct{}
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+type dispatcher struct {
+	id    int
+	local [numPriorities]chan task
+}
+
+// New creates a Scheduler from cfg. The number of dispatchers is
+// runtime.GOMAXPROCS(0), raised to cfg.MinWorkers and then capped to
+// cfg.MaxWorkers; a zero MinWorkers is taken to be MaxWorkers.
+func New(cfg Config) *Scheduler {
+	if cfg.MaxWorkers <= 0 {
+		cfg.MaxWorkers = 1
+	}
+	if cfg.MinWorkers <= 0 {
+		cfg.MinWorkers = cfg.MaxWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = cfg.MaxWorkers * 64
+	}
+	n := runtime.GOMAXPROCS(0)
+	if n < cfg.MinWorkers {
+		n = cfg.MinWorkers
+	}
+	if n > cfg.MaxWorkers {
+		n = cfg.MaxWorkers
+	}
+	if n < 1 {
+		n = 1
+	}
+	s := &Scheduler{
+		cfg:      cfg,
+		disps:    make([]*dispatcher, n),
+		sema:     make(chan struct{}, cfg.MaxWorkers),
+		sessions: make(map[string]chan struct{}),
+		stopCh:   make(chan struct{}),
+	}
+	perDispQueue := cfg.QueueSize/n + 1
+	for i := range s.disps {
+		d := &dispatcher{id: i}
+		for p := 0; p < numPriorities; p++ {
+			d.local[p] = make(chan task, perDispQueue)
+		}
+		s.disps[i] = d
+	}
+	for _, d := range s.disps {
+		go s.runDispatcher(d)
+	}
+	return s
+}
+
+// Go submits fn at PriorityNormal. It returns false if every dispatcher's
+// queue is full.
+func (s *Scheduler) Go(fn func()) bool {
+	return s.GoPriority(PriorityNormal, fn)
+}
+
+// GoPriority submits fn at the given priority. It returns false if every
+// dispatcher's queue is full.
+func (s *Scheduler) GoPriority(priority Priority, fn func()) bool {
+	return s.submit(priority, "", fn)
+}
+
+// GoSession submits fn at the given priority, capped by
+// Config.PerSessionConcurrency for the given session key. It returns
+// false if the session is already at its concurrency cap or every
+// dispatcher's queue is full.
+func (s *Scheduler) GoSession(session string, priority Priority, fn func()) bool {
+	if s.cfg.PerSessionConcurrency > 0 {
+		sem := s.sessionSemaphore(session)
+		select {
+		case sem <- struct{}{}:
+		default:
+			atomic.AddInt64(&s.rejected, 1)
+			return false
+		}
+		wrapped := fn
+		fn = func() {
+			defer func() {
+				<-sem
+				s.releaseSessionIfIdle(session, sem)
+			}()
+			wrapped()
+		}
+		if !s.submit(priority, session, fn) {
+			<-sem
+			s.releaseSessionIfIdle(session, sem)
+			return false
+		}
+		return true
+	}
+	return s.submit(priority, session, fn)
+}
+
+func (s *Scheduler) sessionSemaphore(session string) chan struct{} {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	sem, ok := s.sessions[session]
+	if !ok {
+		sem = make(chan struct{}, s.cfg.PerSessionConcurrency)
+		s.sessions[session] = sem
+	}
+	return sem
+}
+
+// releaseSessionIfIdle drops a session's semaphore from the sessions map
+// once it has no in-flight tasks, so a cluster of short-lived session
+// keys (e.g. one per connection) doesn't leak entries forever.
+func (s *Scheduler) releaseSessionIfIdle(session string, sem chan struct{}) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if len(sem) == 0 && s.sessions[session] == sem {
+		delete(s.sessions, session)
+	}
+}
+
+func (s *Scheduler) submit(priority Priority, session string, fn func()) bool {
+	start := pickDispatcher(len(s.disps))
+	for i := range s.disps {
+		d := s.disps[(start+i)%len(s.disps)]
+		select {
+		case d.local[priority] <- task{fn: fn, session: session}:
+			atomic.AddInt64(&s.queueDepth, 1)
+			return true
+		default:
+		}
+	}
+	atomic.AddInt64(&s.rejected, 1)
+	return false
+}
+
+// runDispatcher pins itself to an OS thread and repeatedly services its
+// own runqueues (highest priority first), falling back to stealing a
+// task from a sibling dispatcher when its own queues are empty. When
+// there is nothing to run anywhere it blocks on its own queues (plus a
+// steal-retry tick) instead of spinning, so an idle scheduler costs no
+// CPU.
+func (s *Scheduler) runDispatcher(d *dispatcher) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	stealTick := time.NewTicker(2 * time.Millisecond)
+	defer stealTick.Stop()
+	for {
+		if t, ok := s.nextTask(d); ok {
+			atomic.AddInt64(&s.queueDepth, -1)
+			s.runTask(t)
+			continue
+		}
+		select {
+		case <-s.stopCh:
+			return
+		case t := <-d.local[PriorityHigh]:
+			atomic.AddInt64(&s.queueDepth, -1)
+			s.runTask(t)
+		case t := <-d.local[PriorityNormal]:
+			atomic.AddInt64(&s.queueDepth, -1)
+			s.runTask(t)
+		case t := <-d.local[PriorityLow]:
+			atomic.AddInt64(&s.queueDepth, -1)
+			s.runTask(t)
+		case <-stealTick.C:
+			// wake up periodically to retry stealing from siblings
+		}
+	}
+}
+
+func (s *Scheduler) nextTask(d *dispatcher) (task, bool) {
+	for p := numPriorities - 1; p >= 0; p-- {
+		select {
+		case t := <-d.local[p]:
+			return t, true
+		default:
+		}
+	}
+	for _, other := range s.disps {
+		if other == d {
+			continue
+		}
+		for p := numPriorities - 1; p >= 0; p-- {
+			select {
+			case t := <-other.local[p]:
+				return t, true
+			default:
+			}
+		}
+	}
+	return task{}, false
+}
+
+// runTask runs t on its own goroutine, bounded by s.sema so that at most
+// cfg.MaxWorkers tasks execute concurrently. Dispatch/steal decisions
+// happen on the OS-thread-pinned dispatcher goroutine, but the task
+// itself runs off that thread so one slow handler can't stall dispatch.
+// Acquiring the semaphore also watches stopCh, so a saturated scheduler's
+// dispatcher does not stay parked forever after Stop is called.
+func (s *Scheduler) runTask(t task) {
+	select {
+	case s.sema <- struct{}{}:
+	case <-s.stopCh:
+		return
+	}
+	atomic.AddInt64(&s.running, 1)
+	go func() {
+		defer func() {
+			<-s.sema
+			atomic.AddInt64(&s.running, -1)
+		}()
+		t.fn()
+	}()
+}
+
+// Stats returns a snapshot of the scheduler's current load, suitable for
+// surfacing through a stats plugin.
+func (s *Scheduler) Stats() Stats {
+	return Stats{
+		QueueDepth: atomic.LoadInt64(&s.queueDepth),
+		Rejected:   atomic.LoadInt64(&s.rejected),
+		Running:    atomic.LoadInt64(&s.running),
+	}
+}
+
+// Stop signals every dispatcher to exit once its queues drain of
+// in-flight steals. Already-running tasks are not interrupted.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+}
+
+var dispatcherCursor uint64
+
+func pickDispatcher(n int) int {
+	return int(atomic.AddUint64(&dispatcherCursor, 1) % uint64(n))
+}
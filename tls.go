@@ -0,0 +1,212 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// TlsOption configures a *tls.Config built by NewTlsConfig. It returns an
+// error instead of panicking/aborting so that options fed by untrusted or
+// rotating input (e.g. WithPEM) can be handled by the caller.
+type TlsOption func(*tls.Config) error
+
+// WithTLS13Only restricts the config to TLS 1.3. TLS 1.3 ignores the
+// manually pinned cipher suite list, so it is dropped.
+func WithTLS13Only() TlsOption {
+	return func(c *tls.Config) error {
+		c.MinVersion = tls.VersionTLS13
+		c.CipherSuites = nil
+		return nil
+	}
+}
+
+// WithClientCAs enables mutual TLS: the peer's certificate is verified
+// against pool and connections without a valid client certificate are
+// rejected.
+func WithClientCAs(pool *x509.CertPool) TlsOption {
+	return func(c *tls.Config) error {
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		return nil
+	}
+}
+
+// WithRootCAs sets the root CA pool used to verify the remote peer's
+// certificate when dialing out.
+func WithRootCAs(pool *x509.CertPool) TlsOption {
+	return func(c *tls.Config) error {
+		c.RootCAs = pool
+		return nil
+	}
+}
+
+// WithPEM loads the certificate/key pair from in-memory PEM blocks,
+// e.g. material fetched from a secret manager instead of the filesystem.
+// A malformed pair is returned as an error from NewTlsConfig rather than
+// aborting the process, since this is the option most likely to receive
+// bad or rotated bytes at runtime.
+func WithPEM(certPEM, keyPEM []byte) TlsOption {
+	return func(c *tls.Config) error {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return err
+		}
+		c.Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
+
+// WithSessionTicketKeys sets the keys used to encrypt/decrypt session
+// resumption tickets, so that the keys can be rotated and shared across a
+// cluster of peer processes.
+func WithSessionTicketKeys(keys [][32]byte) TlsOption {
+	return func(c *tls.Config) error {
+		if len(keys) == 0 {
+			return errors.New("tls: at least one session ticket key is required")
+		}
+		c.SetSessionTicketKeys(keys)
+		return nil
+	}
+}
+
+// NewTlsConfig creates a TLS 1.2+ config with teleport's default cipher
+// suites and curve preferences, then applies opts in order, stopping at
+// the first error. Use WithPEM or load Certificates yourself before
+// passing the config on, since NewTlsConfig on its own does not read from
+// the filesystem.
+func NewTlsConfig(opts ...TlsOption) (*tls.Config, error) {
+	c := &tls.Config{
+		NextProtos:               []string{"http/1.1", "h2"},
+		PreferServerCipherSuites: true,
+		CurvePreferences: []tls.CurveID{
+			tls.CurveP256,
+			tls.X25519,
+		},
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		},
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// NewTlsConfigFromFile creates a new TLS config from a certificate/key
+// file pair. It is a thin wrapper over NewTlsConfig kept for backwards
+// compatibility.
+func NewTlsConfigFromFile(tlsCertFile, tlsKeyFile string, opts ...TlsOption) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewTlsConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.Certificates = []tls.Certificate{cert}
+	return c, nil
+}
+
+// ReloadableTlsConfig wraps a *tls.Config whose certificate/key pair is
+// reloaded from disk on SIGHUP, so long-lived peer processes can rotate
+// certificates without a restart.
+type ReloadableTlsConfig struct {
+	certFile, keyFile string
+	config            *tls.Config
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewReloadableTlsConfig creates a ReloadableTlsConfig that loads
+// tlsCertFile/tlsKeyFile immediately and again on every SIGHUP. The
+// returned *tls.Config's GetCertificate/GetClientCertificate always
+// serve the most recently loaded pair.
+func NewReloadableTlsConfig(tlsCertFile, tlsKeyFile string, opts ...TlsOption) (*ReloadableTlsConfig, error) {
+	config, err := NewTlsConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReloadableTlsConfig{
+		certFile: tlsCertFile,
+		keyFile:  tlsKeyFile,
+		config:   config,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return r.certificate(), nil
+	}
+	r.config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return r.certificate(), nil
+	}
+	r.watchSIGHUP()
+	return r, nil
+}
+
+// Config returns the wrapped, auto-reloading *tls.Config.
+func (r *ReloadableTlsConfig) Config() *tls.Config {
+	return r.config
+}
+
+func (r *ReloadableTlsConfig) certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *ReloadableTlsConfig) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *ReloadableTlsConfig) watchSIGHUP() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			if err := r.reload(); err != nil {
+				Errorf("tls: reload %s/%s: %v", r.certFile, r.keyFile, err)
+				continue
+			}
+			Infof("tls: reloaded certificate %s", r.certFile)
+		}
+	}()
+}
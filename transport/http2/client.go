@@ -0,0 +1,86 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http2
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// Client sends teleport packets as HTTP/2 requests, one stream per packet.
+// With Cleartext set, it dials h2c using AllowHTTP so no TLS handshake is
+// performed.
+type Client struct {
+	Addr      string
+	Cleartext bool
+
+	hc *http.Client
+}
+
+// NewClient creates an HTTP/2 (or h2c) transport client for Addr.
+// tlsConfig is used for the TLS handshake when cleartext is false (e.g. to
+// present a client certificate for mutual TLS); it is ignored for h2c.
+func NewClient(addr string, cleartext bool, tlsConfig *tls.Config) *Client {
+	t := &http2.Transport{AllowHTTP: cleartext, TLSClientConfig: tlsConfig}
+	if cleartext {
+		t.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}
+	}
+	return &Client{
+		Addr:      addr,
+		Cleartext: cleartext,
+		hc:        &http.Client{Transport: t},
+	}
+}
+
+// Send writes p as a single HTTP/2 stream and returns the reply packet.
+func (c *Client) Send(p *socket.Packet) (*socket.Packet, error) {
+	scheme := "https"
+	if c.Cleartext {
+		scheme = "http"
+	}
+	body, _ := p.Body().([]byte)
+	req, err := http.NewRequest(http.MethodPost, scheme+"://"+c.Addr+p.Uri(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	writeHeaders(req.Header, p)
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return packetFromResponse(resp, respBody)
+}
+
+// Close closes idle connections held by the underlying HTTP/2 transport.
+func (c *Client) Close() error {
+	if t, ok := c.hc.Transport.(*http2.Transport); ok {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package http2 binds teleport's PULL/REPLY/PUSH packets to HTTP/2 (and
+// h2c) streams, one packet per stream, so teleport traffic can cross
+// HTTP/2-only infrastructure such as reverse proxies and L7 gateways.
+package http2
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+const (
+	// HeaderPtype carries the teleport packet type (TypePull/TypeReply/TypePush).
+	HeaderPtype = "X-Tp-Ptype"
+	// HeaderSeq carries the teleport packet sequence number.
+	HeaderSeq = "X-Tp-Seq"
+	// HeaderMetaPrefix prefixes teleport packet metadata forwarded as HPACK
+	// headers. The metadata key itself is hex-encoded (e.g. MetaRealId,
+	// "X-Real-ID", is carried as "X-Tp-Meta-582d5265616c2d4944") rather than appended
+	// as-is, because net/http canonicalizes header names
+	// (textproto.CanonicalMIMEHeaderKey) and would otherwise silently
+	// rewrite a mixed-case key such as "X-Real-ID" to "X-Real-Id" on
+	// every round trip. hex is used instead of base64 because
+	// encoding/hex.DecodeString is case-insensitive, so it survives
+	// canonicalization re-casing the first letter of the encoded suffix.
+	HeaderMetaPrefix = "X-Tp-Meta-"
+)
+
+// packetFromRequest reconstructs a *socket.Packet from an inbound HTTP/2
+// stream: Ptype from HeaderPtype, Uri from the request path, Seq from
+// HeaderSeq, and metadata from the HeaderMetaPrefix-prefixed headers. The
+// body is set to the raw bytes read off the DATA frames; no body codec or
+// XferPipe filter is applied to it, here or by the Peer before its Router
+// receives the packet.
+func packetFromRequest(r *http.Request) (*socket.Packet, error) {
+	ptype, err := strconv.ParseUint(r.Header.Get(HeaderPtype), 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := strconv.ParseUint(r.Header.Get(HeaderSeq), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	settings := []socket.PacketSetting{
+		socket.WithPtype(byte(ptype)),
+		socket.WithUri(r.URL.Path),
+		socket.WithSeq(seq),
+	}
+	for key, values := range r.Header {
+		if !strings.HasPrefix(key, HeaderMetaPrefix) {
+			continue
+		}
+		metaKey, err := hex.DecodeString(strings.TrimPrefix(key, HeaderMetaPrefix))
+		if err != nil {
+			continue
+		}
+		for _, v := range values {
+			settings = append(settings, socket.WithAddMeta(string(metaKey), v))
+		}
+	}
+	p := socket.GetPacket(settings...)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	p.SetBody(body)
+	return p, nil
+}
+
+// packetFromResponse is the client-side mirror of packetFromRequest: it
+// rebuilds the reply packet from the response headers and body.
+func packetFromResponse(resp *http.Response, body []byte) (*socket.Packet, error) {
+	ptype, err := strconv.ParseUint(resp.Header.Get(HeaderPtype), 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get(HeaderSeq), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	settings := []socket.PacketSetting{
+		socket.WithPtype(byte(ptype)),
+		socket.WithSeq(seq),
+		socket.WithBody(body),
+	}
+	for key, values := range resp.Header {
+		if !strings.HasPrefix(key, HeaderMetaPrefix) {
+			continue
+		}
+		metaKey, err := hex.DecodeString(strings.TrimPrefix(key, HeaderMetaPrefix))
+		if err != nil {
+			continue
+		}
+		for _, v := range values {
+			settings = append(settings, socket.WithAddMeta(string(metaKey), v))
+		}
+	}
+	return socket.GetPacket(settings...), nil
+}
+
+// writeHeaders writes a packet's framing and metadata onto an outbound
+// HTTP/2 stream's headers, leaving the body to be streamed separately in
+// DATA frames.
+func writeHeaders(h http.Header, p *socket.Packet) {
+	h.Set(HeaderPtype, strconv.Itoa(int(p.Ptype())))
+	h.Set(HeaderSeq, strconv.FormatUint(p.Seq(), 10))
+	p.Meta().VisitAll(func(key, value []byte) {
+		h.Add(HeaderMetaPrefix+hex.EncodeToString(key), string(value))
+	})
+}
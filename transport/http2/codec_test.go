@@ -0,0 +1,74 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http2
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// freeAddr picks an address on an ephemeral port that is very likely free
+// by the time the caller's server binds it.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// TestMixedCaseMetaKeyRoundTrip verifies that mixed-case metadata keys like
+// MetaRealId ("X-Real-ID") and MetaRealIp ("X-Real-IP") survive a real
+// Server/Client round trip unchanged, despite net/http canonicalizing
+// every header name it sees.
+func TestMixedCaseMetaKeyRoundTrip(t *testing.T) {
+	addr := freeAddr(t)
+	const metaRealId = "X-Real-ID"
+	const metaRealIp = "X-Real-IP"
+
+	var gotId, gotIp string
+	srv := NewServer(addr, true, func(_ string, input *socket.Packet) *socket.Packet {
+		gotId = string(input.Meta().Peek(metaRealId))
+		gotIp = string(input.Meta().Peek(metaRealIp))
+		return socket.GetPacket(socket.WithBody([]byte("ok")))
+	})
+	go srv.ListenAndServe()
+	defer srv.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := NewClient(addr, true, nil)
+	defer client.Close()
+
+	req := socket.GetPacket(
+		socket.WithUri("/"),
+		socket.WithAddMeta(metaRealId, "abc-123"),
+		socket.WithAddMeta(metaRealIp, "10.0.0.1"),
+	)
+	if _, err := client.Send(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if gotId != "abc-123" {
+		t.Fatalf("expected %s=%q, got %q", metaRealId, "abc-123", gotId)
+	}
+	if gotIp != "10.0.0.1" {
+		t.Fatalf("expected %s=%q, got %q", metaRealIp, "10.0.0.1", gotIp)
+	}
+}
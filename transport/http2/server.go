@@ -0,0 +1,116 @@
+// Copyright 2015-2017 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http2
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+// Handler processes one decoded packet and returns the packet to write
+// back on the same HTTP/2 stream. remoteAddr is the originating
+// connection's address (http.Request.RemoteAddr), passed through so a
+// Peer can scope per-connection state (e.g. scheduler session dispatch)
+// the same way it does for its raw TCP/TLS transport. A Peer's router is
+// normally installed here so that handlers and plugin hooks work
+// unchanged across transports.
+type Handler func(remoteAddr string, input *socket.Packet) (output *socket.Packet)
+
+// errTLSRequired is returned by ListenAndServe when H2C is false; use
+// ListenAndServeTLS for that case instead.
+var errTLSRequired = errors.New("http2: H2C is false, use ListenAndServeTLS")
+
+// Server binds teleport's PULL/REPLY/PUSH packets to HTTP/2 streams.
+type Server struct {
+	// Addr is the TCP address to listen on.
+	Addr string
+	// H2C enables cleartext HTTP/2 via h2c.NewHandler, for environments
+	// that already terminate TLS at a front proxy.
+	H2C bool
+	// Handler dispatches decoded packets into the rest of teleport.
+	Handler Handler
+	// TLSConfig, if set, is used by ListenAndServeTLS instead of loading
+	// a certificate/key pair from disk (e.g. secret-manager-backed or
+	// mutual-TLS material built with NewTlsConfig).
+	TLSConfig *tls.Config
+
+	srv *http.Server
+}
+
+// NewServer creates an HTTP/2 (or h2c) transport server.
+func NewServer(addr string, h2c bool, handler Handler) *Server {
+	return &Server{Addr: addr, H2C: h2c, Handler: handler}
+}
+
+// ListenAndServe starts accepting cleartext h2c streams.
+// H2C must be true; for TLS-terminated HTTP/2, use ListenAndServeTLS.
+func (s *Server) ListenAndServe() error {
+	if !s.H2C {
+		return errTLSRequired
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveStream)
+	s.srv = &http.Server{
+		Addr:    s.Addr,
+		Handler: h2c.NewHandler(mux, &http2.Server{}),
+	}
+	return s.srv.ListenAndServe()
+}
+
+// ListenAndServeTLS starts accepting HTTP/2 streams over TLS. If
+// certFile/keyFile are empty, TLSConfig must already carry a usable
+// certificate (e.g. via GetCertificate, for mutual-TLS or reloadable
+// setups).
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveStream)
+	s.srv = &http.Server{Addr: s.Addr, Handler: mux, TLSConfig: s.TLSConfig}
+	if err := http2.ConfigureServer(s.srv, &http2.Server{}); err != nil {
+		return err
+	}
+	return s.srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+// Close shuts down the underlying HTTP server.
+func (s *Server) Close() error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Close()
+}
+
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request) {
+	input, err := packetFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	output := s.Handler(r.RemoteAddr, input)
+	socket.PutPacket(input)
+	if output == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeHeaders(w.Header(), output)
+	body, _ := output.Body().([]byte)
+	w.Write(body)
+	socket.PutPacket(output)
+}